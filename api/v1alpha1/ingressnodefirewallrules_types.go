@@ -0,0 +1,84 @@
+package v1alpha1
+
+// ProtocolType is the L4 protocol a FirewallProtocolRule matches on.
+type ProtocolType string
+
+const (
+	ProtocolTypeTCP    ProtocolType = "TCP"
+	ProtocolTypeUDP    ProtocolType = "UDP"
+	ProtocolTypeSCTP   ProtocolType = "SCTP"
+	ProtocolTypeICMP   ProtocolType = "ICMP"
+	ProtocolTypeICMPv6 ProtocolType = "ICMPv6"
+)
+
+// IngressNodeFirewallActionType is the verdict a FirewallProtocolRule applies
+// to matching traffic.
+type IngressNodeFirewallActionType string
+
+const (
+	IngressNodeFirewallAllow IngressNodeFirewallActionType = "Allow"
+	IngressNodeFirewallDeny  IngressNodeFirewallActionType = "Deny"
+)
+
+// IngressNodeFirewallRuleDirection selects which hook(s) a FirewallProtocolRule
+// is enforced at. The zero value, DirectionBoth, preserves the original
+// behavior of enforcing every rule on both ingress and egress.
+type IngressNodeFirewallRuleDirection string
+
+const (
+	DirectionBoth    IngressNodeFirewallRuleDirection = ""
+	DirectionIngress IngressNodeFirewallRuleDirection = "Ingress"
+	DirectionEgress  IngressNodeFirewallRuleDirection = "Egress"
+)
+
+// ProtocolRule matches a destination port or port range for TCP/UDP/SCTP
+// rules. Ports is either a single port ("80") or an inclusive range
+// ("8000-8080").
+type ProtocolRule struct {
+	Ports string `json:"ports,omitempty"`
+}
+
+// ICMPRule matches an ICMP or ICMPv6 type/code pair.
+type ICMPRule struct {
+	ICMPType uint8 `json:"icmpType"`
+	ICMPCode uint8 `json:"icmpCode"`
+}
+
+// TLSRule matches a TLS ClientHello by its SNI server name. ServerNames
+// entries may use a "*." prefix to match any subdomain.
+type TLSRule struct {
+	ServerNames []string `json:"serverNames,omitempty"`
+}
+
+// HTTPRule matches a cleartext HTTP request by its Host header and,
+// optionally, its method.
+type HTTPRule struct {
+	Hosts   []string `json:"hosts,omitempty"`
+	Methods []string `json:"methods,omitempty"`
+}
+
+// L7Rule carries the L7 match criteria for a FirewallProtocolRule; at most
+// one of TLSRule/HTTPRule is expected to be set per rule.
+type L7Rule struct {
+	TLSRule  *TLSRule  `json:"tlsRule,omitempty"`
+	HTTPRule *HTTPRule `json:"httpRule,omitempty"`
+}
+
+// FirewallProtocolRule is one ordered rule within an
+// IngressNodeFirewallRules config.
+type FirewallProtocolRule struct {
+	Order        uint32                           `json:"order"`
+	Protocol     ProtocolType                     `json:"protocol"`
+	ProtocolRule ProtocolRule                     `json:"protocolRule,omitempty"`
+	ICMPRule     ICMPRule                         `json:"icmpRule,omitempty"`
+	Action       IngressNodeFirewallActionType    `json:"action"`
+	Direction    IngressNodeFirewallRuleDirection `json:"direction,omitempty"`
+	L7Match      *L7Rule                          `json:"l7Match,omitempty"`
+}
+
+// IngressNodeFirewallRules is the set of firewall rules shared by a list of
+// source CIDRs, as loaded into the eBPF LPM map by nodefwloader.
+type IngressNodeFirewallRules struct {
+	SourceCIDRs           []string               `json:"sourceCIDRs"`
+	FirewallProtocolRules []FirewallProtocolRule `json:"rules"`
+}
@@ -0,0 +1,175 @@
+package nodefwloader
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"log/syslog"
+	"net"
+	"time"
+)
+
+// exporterQueueDepth bounds the per-exporter backlog so a slow sink (a TCP
+// collector that stalls, a congested Kafka broker) cannot back up and block
+// the perf reader goroutine. Events beyond this depth are dropped and
+// logged rather than applying backpressure.
+const exporterQueueDepth = 1024
+
+// FirewallEvent is the sink-agnostic representation of one aggregated flow,
+// built from a flowRecord once it is expired. Every EventExporter consumes
+// this same shape and is responsible for translating it into its own wire
+// format.
+type FirewallEvent struct {
+	RuleId    uint16
+	Action    uint8
+	IfId      uint16
+	Direction uint8
+	Proto     uint8
+	SrcIP     net.IP
+	DstIP     net.IP
+	SrcPort   uint16
+	DstPort   uint16
+	Packets   uint64
+	Bytes     uint64
+	TCPFlags  uint8
+	FirstSeen time.Time
+	LastSeen  time.Time
+}
+
+// EventExporter delivers FirewallEvents to a sink. Implementations must be
+// safe to call from the fan-out goroutine created for them and should not
+// block indefinitely in Export, since that would stall the bounded queue
+// feeding them.
+type EventExporter interface {
+	Export(FirewallEvent) error
+	Close() error
+}
+
+// exporterFanout owns one bounded queue and worker goroutine per registered
+// EventExporter, so that every sink receives every event concurrently and a
+// slow sink only drops its own backlog instead of blocking the others.
+type exporterFanout struct {
+	queues []chan FirewallEvent
+	done   chan struct{}
+}
+
+// newExporterFanout starts one worker per exporter and returns the fanout
+// handle used to publish events to all of them.
+func newExporterFanout(exporters []EventExporter) *exporterFanout {
+	f := &exporterFanout{
+		queues: make([]chan FirewallEvent, len(exporters)),
+		done:   make(chan struct{}),
+	}
+	for i, exp := range exporters {
+		q := make(chan FirewallEvent, exporterQueueDepth)
+		f.queues[i] = q
+		go func(exp EventExporter, q chan FirewallEvent) {
+			for ev := range q {
+				if err := exp.Export(ev); err != nil {
+					log.Printf("exporter failed to export event: %v", err)
+				}
+			}
+		}(exp, q)
+	}
+	return f
+}
+
+// Export publishes ev to every registered exporter's queue, dropping it for
+// any exporter whose queue is currently full rather than blocking the caller.
+func (f *exporterFanout) Export(ev FirewallEvent) {
+	for _, q := range f.queues {
+		select {
+		case q <- ev:
+		default:
+			log.Printf("exporter queue full, dropping event for ruleId %d", ev.RuleId)
+		}
+	}
+}
+
+// Close drains and stops every exporter worker.
+func (f *exporterFanout) Close() {
+	for _, q := range f.queues {
+		close(q)
+	}
+}
+
+// syslogExporter is the original behavior of ingressNodeFwEvents, kept as one
+// EventExporter implementation among several.
+type syslogExporter struct {
+	w *syslog.Writer
+}
+
+// newSyslogExporter wraps an already-connected syslog writer as an
+// EventExporter.
+func newSyslogExporter(w *syslog.Writer) *syslogExporter {
+	return &syslogExporter{w: w}
+}
+
+func (s *syslogExporter) Export(ev FirewallEvent) error {
+	return s.w.Info(fmt.Sprintf(
+		"ruleId %d action %s direction %s if %d proto %d src %s:%d dst %s:%d packets %d bytes %d tcpFlags 0x%02x first %s last %s\n",
+		ev.RuleId, convertXdpActionToString(ev.Action), convertDirectionToString(ev.Direction), ev.IfId, ev.Proto,
+		ev.SrcIP, ev.SrcPort, ev.DstIP, ev.DstPort,
+		ev.Packets, ev.Bytes, ev.TCPFlags, ev.FirstSeen.Format(time.RFC3339), ev.LastSeen.Format(time.RFC3339)))
+}
+
+func (s *syslogExporter) Close() error {
+	return s.w.Close()
+}
+
+// jsonFirewallEvent is the newline-delimited JSON wire format written by
+// jsonExporter; field names are chosen to be stable API for downstream
+// consumers rather than mirroring the internal FirewallEvent layout.
+type jsonFirewallEvent struct {
+	RuleId    uint16    `json:"ruleId"`
+	Action    string    `json:"action"`
+	Direction string    `json:"direction"`
+	Interface uint16    `json:"interface"`
+	Protocol  uint8     `json:"protocol"`
+	SrcIP     string    `json:"srcIP"`
+	DstIP     string    `json:"dstIP"`
+	SrcPort   uint16    `json:"srcPort"`
+	DstPort   uint16    `json:"dstPort"`
+	Packets   uint64    `json:"packets"`
+	Bytes     uint64    `json:"bytes"`
+	TCPFlags  uint8     `json:"tcpFlags"`
+	FirstSeen time.Time `json:"firstSeen"`
+	LastSeen  time.Time `json:"lastSeen"`
+}
+
+// jsonExporter writes one JSON object per line to an underlying io.WriteCloser,
+// which may be a file or a TCP connection to a remote collector.
+type jsonExporter struct {
+	w   io.WriteCloser
+	enc *json.Encoder
+}
+
+// newJSONExporter wraps w (a file or TCP sink) as a newline-delimited JSON
+// EventExporter.
+func newJSONExporter(w io.WriteCloser) *jsonExporter {
+	return &jsonExporter{w: w, enc: json.NewEncoder(w)}
+}
+
+func (j *jsonExporter) Export(ev FirewallEvent) error {
+	return j.enc.Encode(jsonFirewallEvent{
+		RuleId:    ev.RuleId,
+		Action:    convertXdpActionToString(ev.Action),
+		Direction: convertDirectionToString(ev.Direction),
+		Interface: ev.IfId,
+		Protocol:  ev.Proto,
+		SrcIP:     ev.SrcIP.String(),
+		DstIP:     ev.DstIP.String(),
+		SrcPort:   ev.SrcPort,
+		DstPort:   ev.DstPort,
+		Packets:   ev.Packets,
+		Bytes:     ev.Bytes,
+		TCPFlags:  ev.TCPFlags,
+		FirstSeen: ev.FirstSeen,
+		LastSeen:  ev.LastSeen,
+	})
+}
+
+func (j *jsonExporter) Close() error {
+	return j.w.Close()
+}
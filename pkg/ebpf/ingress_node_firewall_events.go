@@ -28,8 +28,9 @@ func (infc *IngNodeFwController) ingressNodeFwEvents() error {
 	signal.Notify(stopper, os.Interrupt, syscall.SIGTERM)
 
 	// Open a perf event reader from userspace on the PERF_EVENT_ARRAY map
-	// described in the eBPF C program.
-	rd, err := perf.NewReader(objs.IngressNodeFirewallEventsMap, os.Getpagesize())
+	// described in the eBPF C program. The buffer is sized per-CPU so a
+	// busier node gets proportionally more room before the ring overruns.
+	rd, err := perf.NewReader(objs.IngressNodeFirewallEventsMap, perfBufferSize())
 	if err != nil {
 		return fmt.Errorf("Failed creating perf event reader: %q", err)
 	}
@@ -46,20 +47,39 @@ func (infc *IngNodeFwController) ingressNodeFwEvents() error {
 		return fmt.Errorf("failed to connect to syslog: %v", err)
 	}
 
+	log.Printf("Listening for events..")
+
+	exporters := append([]EventExporter{newSyslogExporter(eventsLogger)}, infc.exporters...)
+	fanout := newExporterFanout(exporters)
+
+	flows := newFlowTable(func(rec *flowRecord) { fanout.Export(rec.toFirewallEvent()) })
+	go flows.run()
+
+	sampler := infc.sampler
+	go sampler.run()
+
+	go infc.l7.run()
+
+	// stopper only ever carries a single signal value, so exactly one
+	// goroutine may receive it; do every bit of shutdown cleanup here
+	// instead of splitting it across multiple selects on the same channel.
 	go func() {
 		// Wait for a signal and close the perf reader,
 		// which will interrupt rd.Read() and make the program exit.
 		<-stopper
 		log.Println("Received signal, exiting program..")
 
+		flows.stop()
+		sampler.stop()
+		infc.l7.stop()
+		fanout.Close()
+
 		if err := rd.Close(); err != nil {
 			log.Printf("Closing perf event reader: %q", err)
 			return
 		}
 	}()
 
-	log.Printf("Listening for events..")
-
 	// bpfEventHdrSt is generated by bpf2go.
 	go func() {
 		var eventHdr BpfEventHdrSt
@@ -78,6 +98,7 @@ func (infc *IngNodeFwController) ingressNodeFwEvents() error {
 
 			if record.LostSamples != 0 {
 				log.Printf("Perf event ring buffer full, dropped %d samples", record.LostSamples)
+				sampler.recordDropped(record.LostSamples)
 				continue
 			}
 
@@ -86,10 +107,11 @@ func (infc *IngNodeFwController) ingressNodeFwEvents() error {
 				log.Printf("Parsing perf event header err: %v", err)
 				continue
 			}
-			// Note position of the bytes in the buf slice depends on the layout of bpfEventHdrSt struct
+			// Note position of the bytes in the buf slice depends on the layout of bpfEventHdrSt struct.
 			eventHdr.IfId = binary.LittleEndian.Uint16(buf[0:2])
 			eventHdr.RuleId = binary.LittleEndian.Uint16(buf[2:4])
 			eventHdr.Action = buf[4]
+			eventHdr.Direction = buf[5]
 			eventHdr.PktLength = binary.LittleEndian.Uint16(buf[6:8])
 			packet := make([]byte, eventHdr.PktLength)
 			// Parse the perf event entry into a bpfEvent structure.
@@ -97,62 +119,106 @@ func (infc *IngNodeFwController) ingressNodeFwEvents() error {
 				log.Printf("Parsing perf event packet header : %v", err)
 				continue
 			}
-			// Look up the network interface by index.
-			iface, err := net.InterfaceByIndex(int(eventHdr.IfId))
-			if err != nil {
+			// Look up the network interface by index, just to validate it still exists.
+			if _, err := net.InterfaceByIndex(int(eventHdr.IfId)); err != nil {
 				log.Printf("lookup network iface %d: %s", eventHdr.IfId, err)
 				continue
 			}
-			eventsLogger.Info(fmt.Sprintf("ruleId %d action %s len %d if %s\n",
-				eventHdr.RuleId, convertXdpActionToString(eventHdr.Action), eventHdr.PktLength, iface.Name))
-			decodePacket := gopacket.NewPacket(packet, layers.LayerTypeEthernet, gopacket.Default)
-			// check for IPv4
-			if ip4Layer := decodePacket.Layer(layers.LayerTypeIPv4); ip4Layer != nil {
-				ip, _ := ip4Layer.(*layers.IPv4)
-				eventsLogger.Info(fmt.Sprintf("\tipv4 src addr %s dst addr %s\n", ip.SrcIP.String(), ip.DstIP.String()))
-			}
-			// check for IPv6
-			if ip6Layer := decodePacket.Layer(layers.LayerTypeIPv6); ip6Layer != nil {
-				ip, _ := ip6Layer.(*layers.IPv6)
-				eventsLogger.Info(fmt.Sprintf("\tipv6 src addr %s dst addr %s\n", ip.SrcIP.String(), ip.DstIP.String()))
-			}
-			// check for TCP
-			if tcpLayer := decodePacket.Layer(layers.LayerTypeTCP); tcpLayer != nil {
-				tcp, _ := tcpLayer.(*layers.TCP)
-				eventsLogger.Info(fmt.Sprintf("\ttcp srcPort %d dstPort %d\n", tcp.SrcPort, tcp.DstPort))
-			}
-			// check for UDP
-			if udpLayer := decodePacket.Layer(layers.LayerTypeUDP); udpLayer != nil {
-				udp, _ := udpLayer.(*layers.UDP)
-				eventsLogger.Info(fmt.Sprintf("\tudp srcPort %d dstPort %d\n", udp.SrcPort, udp.DstPort))
-			}
-			// check fo SCTP
-			if sctpLayer := decodePacket.Layer(layers.LayerTypeSCTP); sctpLayer != nil {
-				sctp, _ := sctpLayer.(*layers.SCTP)
-				eventsLogger.Info(fmt.Sprintf("\tsctp srcPort %d dstPort %d\n", sctp.SrcPort, sctp.DstPort))
-			}
-			// check for ICMPv4
-			if icmpv4Layer := decodePacket.Layer(layers.LayerTypeICMPv4); icmpv4Layer != nil {
-				icmp, _ := icmpv4Layer.(*layers.ICMPv4)
-				eventsLogger.Info(fmt.Sprintf("\ticmpv4 type %d code %d\n", icmp.TypeCode.Type(), icmp.TypeCode.Code()))
+
+			sampler.recordProcessed(eventHdr.RuleId, eventHdr.Action)
+
+			decoded, ok := decodePacketForFlow(packet)
+			if !ok {
+				continue
 			}
-			// check for ICMPV6
-			if icmpv6Layer := decodePacket.Layer(layers.LayerTypeICMPv6); icmpv6Layer != nil {
-				icmp, _ := icmpv6Layer.(*layers.ICMPv6)
-				eventsLogger.Info(fmt.Sprintf("\ticmpv6 type %d code %d\n", icmp.TypeCode.Type(), icmp.TypeCode.Code()))
+			if eventHdr.Action == xdpPending {
+				infc.l7.inspect(buildFlowKey(&eventHdr, decoded), eventHdr.RuleId, decoded.payload)
+				continue
 			}
+			flows.update(&eventHdr, decoded)
 		}
 	}()
 
 	return nil
 }
 
+// decodePacketForFlow pulls the 5-tuple fields out of a raw perf-event packet
+// that flowTable needs to key and track a flow. It returns ok=false for
+// packets with neither a recognized L3 nor L4 layer.
+func decodePacketForFlow(packet []byte) (*decodedPacket, bool) {
+	decodePacket := gopacket.NewPacket(packet, layers.LayerTypeEthernet, gopacket.Default)
+	decoded := &decodedPacket{}
+	found := false
+
+	if ip4Layer := decodePacket.Layer(layers.LayerTypeIPv4); ip4Layer != nil {
+		ip, _ := ip4Layer.(*layers.IPv4)
+		decoded.srcIP, decoded.dstIP = ip.SrcIP, ip.DstIP
+		found = true
+	}
+	if ip6Layer := decodePacket.Layer(layers.LayerTypeIPv6); ip6Layer != nil {
+		ip, _ := ip6Layer.(*layers.IPv6)
+		decoded.srcIP, decoded.dstIP = ip.SrcIP, ip.DstIP
+		found = true
+	}
+	if tcpLayer := decodePacket.Layer(layers.LayerTypeTCP); tcpLayer != nil {
+		tcp, _ := tcpLayer.(*layers.TCP)
+		decoded.srcPort, decoded.dstPort = uint16(tcp.SrcPort), uint16(tcp.DstPort)
+		decoded.proto = uint8(syscall.IPPROTO_TCP)
+		decoded.tcp = tcp
+		decoded.payload = tcp.LayerPayload()
+		found = true
+	}
+	if udpLayer := decodePacket.Layer(layers.LayerTypeUDP); udpLayer != nil {
+		udp, _ := udpLayer.(*layers.UDP)
+		decoded.srcPort, decoded.dstPort = uint16(udp.SrcPort), uint16(udp.DstPort)
+		decoded.proto = uint8(syscall.IPPROTO_UDP)
+		found = true
+	}
+	if sctpLayer := decodePacket.Layer(layers.LayerTypeSCTP); sctpLayer != nil {
+		sctp, _ := sctpLayer.(*layers.SCTP)
+		decoded.srcPort, decoded.dstPort = uint16(sctp.SrcPort), uint16(sctp.DstPort)
+		decoded.proto = uint8(syscall.IPPROTO_SCTP)
+		found = true
+	}
+	if icmpv4Layer := decodePacket.Layer(layers.LayerTypeICMPv4); icmpv4Layer != nil {
+		decoded.proto = uint8(syscall.IPPROTO_ICMP)
+		found = true
+	}
+	if icmpv6Layer := decodePacket.Layer(layers.LayerTypeICMPv6); icmpv6Layer != nil {
+		decoded.proto = uint8(syscall.IPPROTO_ICMPV6)
+		found = true
+	}
+
+	return decoded, found
+}
+
+// eventDirIngress and eventDirEgress are the values carried in
+// BpfEventHdrSt.Direction, set by the kernel program depending on whether it
+// is running at the XDP ingress or TC egress hook.
+const (
+	eventDirIngress uint8 = 0
+	eventDirEgress  uint8 = 1
+)
+
+func convertDirectionToString(direction uint8) string {
+	switch direction {
+	case eventDirIngress:
+		return "Ingress"
+	case eventDirEgress:
+		return "Egress"
+	default:
+		return fmt.Sprintf("Invalid direction %d", direction)
+	}
+}
+
 func convertXdpActionToString(action uint8) string {
 	switch action {
 	case xdpDeny:
 		return "Drop"
 	case xdpAllow:
 		return "Allow"
+	case xdpPending:
+		return "Pending"
 	default:
 		return fmt.Sprintf("Invalid action %d", action)
 	}
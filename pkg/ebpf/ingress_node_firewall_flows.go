@@ -0,0 +1,225 @@
+package nodefwloader
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+const (
+	// defaultActiveFlowTimeout bounds how long a flow can stay open before it is
+	// force-expired and reported, even if packets are still arriving.
+	defaultActiveFlowTimeout = 60 * time.Second
+	// defaultIdleFlowTimeout expires a flow once no packets have been seen for
+	// this long.
+	defaultIdleFlowTimeout = 15 * time.Second
+	// flowSweepInterval controls how often the expiry goroutine scans the table.
+	flowSweepInterval = 5 * time.Second
+)
+
+// flowKey is the 5-tuple (plus the rule/interface that matched) used to group
+// perf events into a single aggregated flow record, the same approach
+// Clovisor uses for its session_key_t table.
+type flowKey struct {
+	srcIP     [16]byte
+	dstIP     [16]byte
+	srcPort   uint16
+	dstPort   uint16
+	proto     uint8
+	ruleId    uint16
+	ifId      uint16
+	direction uint8
+}
+
+// flowRecord accumulates the counters and metadata for one active flowKey
+// between the time it is first seen and the time it is expired.
+type flowRecord struct {
+	key       flowKey
+	firstSeen time.Time
+	lastSeen  time.Time
+	packets   uint64
+	bytes     uint64
+	tcpFlags  uint8
+	action    uint8
+	isTCP     bool
+}
+
+// flowTable tracks active flows and periodically expires them into aggregated
+// events so that ingressNodeFwEvents can emit one log line per flow instead
+// of one per packet.
+type flowTable struct {
+	mu            sync.Mutex
+	flows         map[flowKey]*flowRecord
+	activeTimeout time.Duration
+	idleTimeout   time.Duration
+	emit          func(*flowRecord)
+	stopCh        chan struct{}
+}
+
+// newFlowTable creates a flowTable that calls emit for every flow it expires.
+func newFlowTable(emit func(*flowRecord)) *flowTable {
+	return &flowTable{
+		flows:         make(map[flowKey]*flowRecord),
+		activeTimeout: defaultActiveFlowTimeout,
+		idleTimeout:   defaultIdleFlowTimeout,
+		emit:          emit,
+		stopCh:        make(chan struct{}),
+	}
+}
+
+// buildFlowKey derives the 5-tuple-plus-rule key a perf event belongs to; it
+// is shared by normal flow aggregation and the L7 pending-verdict path so
+// both agree on what identifies a flow.
+func buildFlowKey(hdr *BpfEventHdrSt, decoded *decodedPacket) flowKey {
+	key := flowKey{
+		srcPort:   decoded.srcPort,
+		dstPort:   decoded.dstPort,
+		proto:     decoded.proto,
+		ruleId:    hdr.RuleId,
+		ifId:      hdr.IfId,
+		direction: hdr.Direction,
+	}
+	copy(key.srcIP[:], decoded.srcIP.To16())
+	copy(key.dstIP[:], decoded.dstIP.To16())
+	return key
+}
+
+// update folds one decoded perf event into the matching flow record, creating
+// it if this is the first packet seen for the 5-tuple. TCP flows carrying a
+// FIN or RST are flushed immediately rather than waiting for the idle timer.
+func (ft *flowTable) update(hdr *BpfEventHdrSt, decoded *decodedPacket) {
+	key := buildFlowKey(hdr, decoded)
+
+	now := time.Now()
+
+	ft.mu.Lock()
+	rec, ok := ft.flows[key]
+	if !ok {
+		rec = &flowRecord{key: key, firstSeen: now}
+		ft.flows[key] = rec
+	}
+	rec.lastSeen = now
+	rec.packets++
+	rec.bytes += uint64(hdr.PktLength)
+	rec.action = hdr.Action
+	if decoded.tcp != nil {
+		rec.isTCP = true
+		rec.tcpFlags |= tcpFlagsToBitmap(decoded.tcp)
+	}
+	flush := rec.isTCP && decoded.tcp != nil && (decoded.tcp.FIN || decoded.tcp.RST)
+	if flush {
+		delete(ft.flows, key)
+	}
+	ft.mu.Unlock()
+
+	if flush {
+		ft.emit(rec)
+	}
+}
+
+// run sweeps the flow table on flowSweepInterval, expiring any flow that has
+// exceeded its active or idle timeout, until stop is called.
+func (ft *flowTable) run() {
+	ticker := time.NewTicker(flowSweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			ft.sweep()
+		case <-ft.stopCh:
+			return
+		}
+	}
+}
+
+// sweep expires and emits every flow past its active or idle timeout.
+func (ft *flowTable) sweep() {
+	now := time.Now()
+	var expired []*flowRecord
+
+	ft.mu.Lock()
+	for key, rec := range ft.flows {
+		if now.Sub(rec.firstSeen) >= ft.activeTimeout || now.Sub(rec.lastSeen) >= ft.idleTimeout {
+			expired = append(expired, rec)
+			delete(ft.flows, key)
+		}
+	}
+	ft.mu.Unlock()
+
+	for _, rec := range expired {
+		ft.emit(rec)
+	}
+}
+
+// stop terminates the sweep goroutine.
+func (ft *flowTable) stop() {
+	close(ft.stopCh)
+}
+
+// tcpFlagsToBitmap folds the booleans gopacket exposes for a TCP layer into
+// the on-the-wire flag bitmap so callers can union flags across a flow.
+func tcpFlagsToBitmap(tcp *layers.TCP) uint8 {
+	var flags uint8
+	if tcp.FIN {
+		flags |= 0x01
+	}
+	if tcp.SYN {
+		flags |= 0x02
+	}
+	if tcp.RST {
+		flags |= 0x04
+	}
+	if tcp.PSH {
+		flags |= 0x08
+	}
+	if tcp.ACK {
+		flags |= 0x10
+	}
+	if tcp.URG {
+		flags |= 0x20
+	}
+	if tcp.ECE {
+		flags |= 0x40
+	}
+	if tcp.CWR {
+		flags |= 0x80
+	}
+	return flags
+}
+
+// decodedPacket is the subset of gopacket layers that ingressNodeFwEvents
+// cares about when keying and logging a flow.
+type decodedPacket struct {
+	srcIP   net.IP
+	dstIP   net.IP
+	srcPort uint16
+	dstPort uint16
+	proto   uint8
+	tcp     *layers.TCP
+	// payload is the TCP segment's application data, populated only for TCP
+	// packets; it is what the L7 inspector parses for a SNI or HTTP request.
+	payload []byte
+}
+
+// toFirewallEvent converts an expired flow record into the exporter-facing
+// FirewallEvent shape, which is independent of any one sink's wire format.
+func (rec *flowRecord) toFirewallEvent() FirewallEvent {
+	return FirewallEvent{
+		RuleId:    rec.key.ruleId,
+		Action:    rec.action,
+		IfId:      rec.key.ifId,
+		Direction: rec.key.direction,
+		Proto:     rec.key.proto,
+		SrcIP:     net.IP(rec.key.srcIP[:]),
+		DstIP:     net.IP(rec.key.dstIP[:]),
+		SrcPort:   rec.key.srcPort,
+		DstPort:   rec.key.dstPort,
+		Packets:   rec.packets,
+		Bytes:     rec.bytes,
+		TCPFlags:  rec.tcpFlags,
+		FirstSeen: rec.firstSeen,
+		LastSeen:  rec.lastSeen,
+	}
+}
@@ -0,0 +1,60 @@
+package nodefwloader
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFlowTableSweepExpiresIdleFlow(t *testing.T) {
+	var emitted []*flowRecord
+	ft := newFlowTable(func(rec *flowRecord) { emitted = append(emitted, rec) })
+	ft.idleTimeout = time.Millisecond
+	ft.activeTimeout = time.Hour
+
+	key := flowKey{srcPort: 1234, dstPort: 80, proto: 6}
+	ft.flows[key] = &flowRecord{key: key, firstSeen: time.Now(), lastSeen: time.Now().Add(-time.Second)}
+
+	ft.sweep()
+
+	if len(emitted) != 1 {
+		t.Fatalf("expected 1 emitted flow, got %d", len(emitted))
+	}
+	if _, ok := ft.flows[key]; ok {
+		t.Fatalf("expired flow was not removed from the table")
+	}
+}
+
+func TestFlowTableSweepExpiresActiveFlow(t *testing.T) {
+	var emitted []*flowRecord
+	ft := newFlowTable(func(rec *flowRecord) { emitted = append(emitted, rec) })
+	ft.idleTimeout = time.Hour
+	ft.activeTimeout = time.Millisecond
+
+	key := flowKey{srcPort: 1234, dstPort: 80, proto: 6}
+	ft.flows[key] = &flowRecord{key: key, firstSeen: time.Now().Add(-time.Second), lastSeen: time.Now()}
+
+	ft.sweep()
+
+	if len(emitted) != 1 {
+		t.Fatalf("expected 1 emitted flow, got %d", len(emitted))
+	}
+}
+
+func TestFlowTableSweepKeepsFreshFlow(t *testing.T) {
+	var emitted []*flowRecord
+	ft := newFlowTable(func(rec *flowRecord) { emitted = append(emitted, rec) })
+	ft.idleTimeout = time.Hour
+	ft.activeTimeout = time.Hour
+
+	key := flowKey{srcPort: 1234, dstPort: 80, proto: 6}
+	ft.flows[key] = &flowRecord{key: key, firstSeen: time.Now(), lastSeen: time.Now()}
+
+	ft.sweep()
+
+	if len(emitted) != 0 {
+		t.Fatalf("expected 0 emitted flows, got %d", len(emitted))
+	}
+	if _, ok := ft.flows[key]; !ok {
+		t.Fatalf("fresh flow should not have been removed from the table")
+	}
+}
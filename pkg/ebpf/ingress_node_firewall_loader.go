@@ -13,6 +13,7 @@ import (
 	"github.com/cilium/ebpf"
 	"github.com/cilium/ebpf/link"
 	"github.com/cilium/ebpf/rlimit"
+	"github.com/prometheus/client_golang/prometheus"
 	"k8s.io/klog"
 
 	ingressnodefwiov1alpha1 "ingress-node-firewall/api/v1alpha1"
@@ -22,6 +23,15 @@ const (
 	xdpDeny   = 1 // XDP_DROP value
 	xdpAllow  = 2 // XDP_PASS value
 	bpfFSPath = "/sys/fs/bpf"
+
+	// dirBothBit, dirIngressOnlyBit and dirEgressOnlyBit are OR'd into
+	// bpfRulesValSt.Action to tell the kernel program which hook(s) a rule
+	// is enforced at, since XDP ingress and TC egress now share the same
+	// LPM map. They are selected from FirewallProtocolRule.Direction by
+	// directionBit below.
+	dirBothBit        = 0x00
+	dirIngressOnlyBit = 0x40
+	dirEgressOnlyBit  = 0x80
 )
 
 // IngNodeFwController structure is the object hold controls for starting
@@ -29,10 +39,33 @@ const (
 type IngNodeFwController struct {
 	// eBPF objs to create/update eBPF maps
 	objs bpfObjects
-	// eBPF interfaces attachment objects
-	links []link.Link
+	// eBPF XDP ingress attachment objects
+	xdpLinks []link.Link
+	// eBPF TC egress attachment objects
+	tcLinks []link.Link
 	// eBPF pingPath
 	pinPath string
+	// additional event sinks fanned out to alongside the default syslog writer
+	exporters []EventExporter
+	// l7 resolves verdicts for flows the kernel program marks xdpPending
+	l7 *l7Inspector
+	// sampler adapts the kernel's per-bucket event sampling rate to perf
+	// ring drop pressure
+	sampler *perfSampler
+}
+
+// MetricsRegistry returns the Prometheus registry the perf-ring sampler
+// publishes its dropped/processed/sampled counters to, so the caller can
+// serve it over its own /metrics endpoint.
+func (infc *IngNodeFwController) MetricsRegistry() *prometheus.Registry {
+	return infc.sampler.registry
+}
+
+// RegisterExporter adds exp to the set of sinks that receive every aggregated
+// flow event, in addition to the default syslog writer. It must be called
+// before IngressNodeFwRulesLoader starts the perf reader.
+func (infc *IngNodeFwController) RegisterExporter(exp EventExporter) {
+	infc.exporters = append(infc.exporters, exp)
 }
 
 // $BPF_CLANG and $BPF_CFLAGS are set by the Makefile.
@@ -54,10 +87,47 @@ func NewIngNodeFwController() (*IngNodeFwController, error) {
 	if err := loadBpfObjects(&objs, &ebpf.CollectionOptions{Maps: ebpf.MapOptions{PinPath: pinDir}}); err != nil {
 		return nil, fmt.Errorf("loading objects: pinDir:%s, err:%s", pinDir, err)
 	}
-	return &IngNodeFwController{
+	infc := &IngNodeFwController{
 		objs:    objs,
 		pinPath: pinDir,
-	}, nil
+	}
+	infc.l7 = newL7Inspector(infc.pushL7Decision)
+	infc.sampler = newPerfSampler(infc.pushSampleRate)
+	return infc, nil
+}
+
+// pushSampleRate writes the 1-in-K sampling rate for one (ruleId, action)
+// bucket into the eBPF map the kernel program consults before emitting an
+// event, so sustained perf ring drop pressure results in fewer, not zero,
+// emitted samples while rule statistics keep counting every packet.
+func (infc *IngNodeFwController) pushSampleRate(key sampleBucketKey, rate uint32) error {
+	skey := bpfSampleKeySt{RuleId: key.ruleId, Action: key.action}
+	return infc.objs.bpfMaps.IngressNodeFirewallSampleMap.Update(skey, rate, ebpf.UpdateAny)
+}
+
+// pushL7Decision writes a per-flow L7 verdict into the eBPF decision map the
+// kernel program consults for subsequent packets of the same flow.
+func (infc *IngNodeFwController) pushL7Decision(key flowKey, verdict uint8) {
+	dkey := bpfL7DecisionKeySt{
+		SrcIp:   key.srcIP,
+		DstIp:   key.dstIP,
+		SrcPort: key.srcPort,
+		DstPort: key.dstPort,
+		Proto:   key.proto,
+	}
+	// The kernel program keys an IPv4 flow by its 4-byte address zero-padded
+	// to 16 bytes, not by the v4-mapped form flowKey holds.
+	if ip4 := net.IP(key.srcIP[:]).To4(); ip4 != nil {
+		dkey.SrcIp = [16]uint8{}
+		copy(dkey.SrcIp[:], ip4)
+	}
+	if ip4 := net.IP(key.dstIP[:]).To4(); ip4 != nil {
+		dkey.DstIp = [16]uint8{}
+		copy(dkey.DstIp[:], ip4)
+	}
+	if err := infc.objs.bpfMaps.IngressNodeFirewallL7DecisionMap.Update(dkey, verdict, ebpf.UpdateAny); err != nil {
+		log.Printf("Failed updating L7 decision map: %v", err)
+	}
 }
 
 // IngressNodeFwRulesLoader Add/Update/Delete ingress nod firewll rules to eBPF LPM MAP
@@ -130,14 +200,31 @@ func (infc *IngNodeFwController) makeIngressFwRulesMap(ingFirewallConfig ingress
 		default:
 			return fmt.Errorf("Failed invalid protocol %v", rule.Protocol)
 		}
+		var baseAction uint8
 		switch rule.Action {
 		case ingressnodefwiov1alpha1.IngressNodeFirewallAllow:
-			rules.Rules[idx].Action = xdpAllow
+			baseAction = xdpAllow
 		case ingressnodefwiov1alpha1.IngressNodeFirewallDeny:
-			rules.Rules[idx].Action = xdpDeny
+			baseAction = xdpDeny
 		default:
 			return fmt.Errorf("Failed invalid action %v", rule.Action)
 		}
+		rules.Rules[idx].Action = baseAction | directionBit(rule.Direction)
+
+		// An Allow rule with an L7Match is enforced in two stages (a Deny
+		// rule drops at once): the kernel program emits xdpPending for its
+		// first packets instead of a verdict, and infc.l7 resolves the real
+		// allow/deny in userspace
+		// once it has seen enough of the flow to check the SNI or HTTP
+		// Host/method.
+		if rule.L7Match != nil {
+			rules.Rules[idx].L7MatchEnabled = 1
+		}
+		if isDelete {
+			infc.l7.setRule(uint16(rule.Order), nil)
+		} else {
+			infc.l7.setRule(uint16(rule.Order), rule.L7Match)
+		}
 	}
 
 	// Parse CIDRs to construct map keys wih shared rules
@@ -169,7 +256,8 @@ func (infc *IngNodeFwController) makeIngressFwRulesMap(ingFirewallConfig ingress
 	return nil
 }
 
-// IngressNodeFwAttach attach eBPF program to list interfaces and pin them to different pinDir
+// IngressNodeFwAttach attach eBPF programs to the list of interfaces at both
+// XDP ingress and TC clsact egress, and pin them to different pinDirs.
 func (infc *IngNodeFwController) IngressNodeFwAttach(ifacesName []string, isDelete bool) error {
 	objs := infc.objs
 	for _, ifaceName := range ifacesName {
@@ -179,31 +267,53 @@ func (infc *IngNodeFwController) IngressNodeFwAttach(ifacesName []string, isDele
 			return fmt.Errorf("lookup network iface %q: %s", ifaceName, err)
 		}
 		if !isDelete {
-			// Attach the program.
-			l, err := link.AttachXDP(link.XDPOptions{
+			// Attach the ingress program.
+			xdpLink, err := link.AttachXDP(link.XDPOptions{
 				Program:   objs.IngresNodeFirewallProcess,
 				Interface: iface.Index,
 			})
 			if err != nil {
 				return fmt.Errorf("could not attach XDP program: %s", err)
 			}
-			lPinDir := path.Join(infc.pinPath, ifaceName+"_link")
-			if err := l.Pin(lPinDir); err != nil {
-				return fmt.Errorf("failed to pin link to pinDir %s: %s", lPinDir, err)
+			xdpPinDir := path.Join(infc.pinPath, ifaceName+"_xdp_link")
+			if err := xdpLink.Pin(xdpPinDir); err != nil {
+				return fmt.Errorf("failed to pin link to pinDir %s: %s", xdpPinDir, err)
+			}
+			infc.xdpLinks = append(infc.xdpLinks, xdpLink)
+			log.Printf("Attached IngressNode Firewall program to iface %q (index %d) at XDP ingress", iface.Name, iface.Index)
+
+			// Attach the egress program on the same interface's clsact
+			// qdisc, sharing the LPM map populated by makeIngressFwRulesMap.
+			tcLink, err := link.AttachTCX(link.TCXOptions{
+				Program:   objs.IngressNodeFirewallProcessEgress,
+				Attach:    ebpf.AttachTCXEgress,
+				Interface: iface.Index,
+			})
+			if err != nil {
+				return fmt.Errorf("could not attach TC egress program: %s", err)
+			}
+			tcPinDir := path.Join(infc.pinPath, ifaceName+"_tc_link")
+			if err := tcLink.Pin(tcPinDir); err != nil {
+				return fmt.Errorf("failed to pin link to pinDir %s: %s", tcPinDir, err)
 			}
-			infc.links = append(infc.links, l)
-			log.Printf("Attached IngressNode Firewall program to iface %q (index %d)", iface.Name, iface.Index)
+			infc.tcLinks = append(infc.tcLinks, tcLink)
+			log.Printf("Attached IngressNode Firewall program to iface %q (index %d) at TC egress", iface.Name, iface.Index)
 		} else {
-			log.Printf("Unattaching IngressNode Firewall program from iface %q (index %d)", iface.Name, iface.Index)
+			log.Printf("Unattaching IngressNode Firewall programs from iface %q (index %d)", iface.Name, iface.Index)
 			infc.cleanup()
 		}
 	}
 	return nil
 }
 
-// cleanup will delete all link objects for all interfaces and remove all the maps
+// cleanup will delete all XDP and TC link objects for all interfaces and remove all the maps
 func (infc *IngNodeFwController) cleanup() {
-	for _, l := range infc.links {
+	for _, l := range infc.xdpLinks {
+		l := l
+		l.Unpin()
+		l.Close()
+	}
+	for _, l := range infc.tcLinks {
 		l := l
 		l.Unpin()
 		l.Close()
@@ -211,6 +321,21 @@ func (infc *IngNodeFwController) cleanup() {
 	infc.objs.Close()
 }
 
+// directionBit maps a rule's Direction to the Action bit the kernel program
+// tests to decide whether it applies at the XDP ingress hook, the TC egress
+// hook, or both; the zero value, DirectionBoth, preserves the pre-existing
+// behavior of enforcing every rule at both hooks.
+func directionBit(dir ingressnodefwiov1alpha1.IngressNodeFirewallRuleDirection) uint8 {
+	switch dir {
+	case ingressnodefwiov1alpha1.DirectionIngress:
+		return dirIngressOnlyBit
+	case ingressnodefwiov1alpha1.DirectionEgress:
+		return dirEgressOnlyBit
+	default:
+		return dirBothBit
+	}
+}
+
 func parseDstPorts(ports string) (uint16, uint16, error) {
 	if !strings.Contains(ports, "-") {
 		port, err := strconv.ParseUint(ports, 10, 16)
@@ -232,4 +357,4 @@ func parseDstPorts(ports string) (uint16, uint16, error) {
 		return 0, 0, fmt.Errorf("invalid End DstPort number %s", err)
 	}
 	return uint16(startPort), uint16(endPort), nil
-}
\ No newline at end of file
+}
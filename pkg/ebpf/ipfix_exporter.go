@@ -0,0 +1,190 @@
+package nodefwloader
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"sync"
+	"time"
+)
+
+// IPFIX information element numbers used by ipfixExporter, from the IANA
+// IPFIX Entities registry.
+const (
+	ieSourceIPv4Address        uint16 = 8
+	ieDestinationIPv4Address   uint16 = 12
+	ieSourceIPv6Address        uint16 = 27
+	ieDestinationIPv6Address   uint16 = 28
+	ieSourceTransportPort      uint16 = 7
+	ieDestinationTransportPort uint16 = 11
+	ieProtocolIdentifier       uint16 = 4
+	iePacketDeltaCount         uint16 = 2
+	ieOctetDeltaCount          uint16 = 1
+	ieFlowStartMilliseconds    uint16 = 152
+	ieFlowEndMilliseconds      uint16 = 153
+	ieIngressInterface         uint16 = 10
+
+	// ipfixEnterpriseNumber is a private enterprise number under which the
+	// ruleId/action fields are registered as enterprise-specific IEs, since
+	// neither has a standard IANA element.
+	ipfixEnterpriseNumber uint32 = 55555
+	ieEnterpriseRuleId    uint16 = 1 | 0x8000
+	ieEnterpriseAction    uint16 = 2 | 0x8000
+	ieEnterpriseDirection uint16 = 3 | 0x8000
+
+	ipfixVersion       uint16 = 10
+	ipfixTemplateSetID uint16 = 2
+
+	// ipfixTemplateIDv4 and ipfixTemplateIDv6 are two distinct Template
+	// Records, differing only in whether the source/destination address IEs
+	// are the 4-byte or 16-byte variants, so a flow's address family is
+	// preserved on the wire instead of every flow being padded/truncated to
+	// one fixed-width address IE.
+	ipfixTemplateIDv4 uint16 = 256
+	ipfixTemplateIDv6 uint16 = 257
+
+	// ipfixTemplateResendInterval bounds how long an exporter ever goes
+	// without retransmitting its Template Set(s), so a collector that
+	// restarts or joins after the first Export can still decode Data Sets
+	// (RFC 7011 section 8.1 recommends periodic template retransmission for
+	// exactly this reason).
+	ipfixTemplateResendInterval = 60 * time.Second
+)
+
+// ipfixExporter maps aggregated flow records onto IPFIX (RFC 7011) Data
+// Records, choosing the IPv4 or IPv6 Template Record to match each flow's
+// address family, and writes the resulting messages to a UDP collector.
+type ipfixExporter struct {
+	conn     io.WriteCloser
+	domainID uint32
+	mu       sync.Mutex
+	seq      uint32
+	// lastTemplate is when the Template Set(s) were last (re)sent; the zero
+	// value forces them onto the very first Export.
+	lastTemplate time.Time
+}
+
+// newIPFIXExporter wraps an already-dialed UDP connection to an IPFIX/NetFlow
+// v9 collector as an EventExporter.
+func newIPFIXExporter(conn io.WriteCloser, observationDomainID uint32) *ipfixExporter {
+	return &ipfixExporter{conn: conn, domainID: observationDomainID}
+}
+
+func (i *ipfixExporter) Export(ev FirewallEvent) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	var buf bytes.Buffer
+	// RFC 7011 section 8.1 recommends periodically retransmitting Template
+	// Sets so a collector that starts or reconnects after the first export
+	// can still decode Data Sets; resending both templates together also
+	// keeps this simple regardless of which address family shows up next.
+	if time.Since(i.lastTemplate) >= ipfixTemplateResendInterval {
+		writeIPFIXTemplateSet(&buf, ipfixTemplateIDv4, ieSourceIPv4Address, ieDestinationIPv4Address, 4)
+		writeIPFIXTemplateSet(&buf, ipfixTemplateIDv6, ieSourceIPv6Address, ieDestinationIPv6Address, 16)
+		i.lastTemplate = time.Now()
+	}
+	writeIPFIXDataSet(&buf, ev)
+
+	header := ipfixMessageHeader(uint16(16+buf.Len()), i.domainID, i.seq)
+	i.seq++
+
+	msg := append(header, buf.Bytes()...)
+	_, err := i.conn.Write(msg)
+	return err
+}
+
+func (i *ipfixExporter) Close() error {
+	return i.conn.Close()
+}
+
+// ipfixMessageHeader builds the 16-byte IPFIX Message Header described in
+// RFC 7011 section 3.1. exportTime is intentionally left as 0 here; the
+// collector is expected to use the flow's own Start/EndMilliseconds IEs.
+func ipfixMessageHeader(length uint16, domainID, seq uint32) []byte {
+	hdr := make([]byte, 16)
+	binary.BigEndian.PutUint16(hdr[0:2], ipfixVersion)
+	binary.BigEndian.PutUint16(hdr[2:4], length)
+	binary.BigEndian.PutUint32(hdr[4:8], 0)
+	binary.BigEndian.PutUint32(hdr[8:12], seq)
+	binary.BigEndian.PutUint32(hdr[12:16], domainID)
+	return hdr
+}
+
+// writeIPFIXTemplateSet emits one Template Record under templateID, using
+// srcIE/dstIE (sized addrLen bytes) for the source/destination address IEs so
+// the same layout function serves both the IPv4 and IPv6 templates.
+func writeIPFIXTemplateSet(buf *bytes.Buffer, templateID uint16, srcIE, dstIE uint16, addrLen uint16) {
+	var fields bytes.Buffer
+	var fieldCount uint16
+
+	writeIE := func(ieID, length uint16) {
+		binary.Write(&fields, binary.BigEndian, ieID)
+		binary.Write(&fields, binary.BigEndian, length)
+		fieldCount++
+	}
+	writeEnterpriseIE := func(ieID, length uint16) {
+		binary.Write(&fields, binary.BigEndian, ieID)
+		binary.Write(&fields, binary.BigEndian, length)
+		binary.Write(&fields, binary.BigEndian, ipfixEnterpriseNumber)
+		fieldCount++
+	}
+
+	writeIE(srcIE, addrLen)
+	writeIE(dstIE, addrLen)
+	writeIE(ieSourceTransportPort, 2)
+	writeIE(ieDestinationTransportPort, 2)
+	writeIE(ieProtocolIdentifier, 1)
+	writeIE(iePacketDeltaCount, 8)
+	writeIE(ieOctetDeltaCount, 8)
+	writeIE(ieFlowStartMilliseconds, 8)
+	writeIE(ieFlowEndMilliseconds, 8)
+	writeIE(ieIngressInterface, 2)
+	writeEnterpriseIE(ieEnterpriseRuleId, 2)
+	writeEnterpriseIE(ieEnterpriseAction, 1)
+	writeEnterpriseIE(ieEnterpriseDirection, 1)
+
+	// fieldCount is derived from the writeIE/writeEnterpriseIE calls above
+	// instead of a separate hardcoded constant, so it can't drift out of
+	// sync with the fields actually written.
+	var tmpl bytes.Buffer
+	binary.Write(&tmpl, binary.BigEndian, templateID)
+	binary.Write(&tmpl, binary.BigEndian, fieldCount)
+	tmpl.Write(fields.Bytes())
+
+	binary.Write(buf, binary.BigEndian, ipfixTemplateSetID)
+	binary.Write(buf, binary.BigEndian, uint16(4+tmpl.Len()))
+	buf.Write(tmpl.Bytes())
+}
+
+// writeIPFIXDataSet emits one Data Set containing a single Data Record for
+// ev, using the IPv4 or IPv6 template (and address width) depending on
+// ev.SrcIP's actual address family, matching the field order of
+// writeIPFIXTemplateSet.
+func writeIPFIXDataSet(buf *bytes.Buffer, ev FirewallEvent) {
+	var rec bytes.Buffer
+	templateID := ipfixTemplateIDv6
+	srcIP, dstIP := ev.SrcIP.To16(), ev.DstIP.To16()
+	if v4 := ev.SrcIP.To4(); v4 != nil {
+		templateID = ipfixTemplateIDv4
+		srcIP, dstIP = v4, ev.DstIP.To4()
+	}
+
+	rec.Write(srcIP)
+	rec.Write(dstIP)
+	binary.Write(&rec, binary.BigEndian, ev.SrcPort)
+	binary.Write(&rec, binary.BigEndian, ev.DstPort)
+	rec.WriteByte(ev.Proto)
+	binary.Write(&rec, binary.BigEndian, ev.Packets)
+	binary.Write(&rec, binary.BigEndian, ev.Bytes)
+	binary.Write(&rec, binary.BigEndian, uint64(ev.FirstSeen.UnixMilli()))
+	binary.Write(&rec, binary.BigEndian, uint64(ev.LastSeen.UnixMilli()))
+	binary.Write(&rec, binary.BigEndian, ev.IfId)
+	binary.Write(&rec, binary.BigEndian, ev.RuleId)
+	rec.WriteByte(ev.Action)
+	rec.WriteByte(ev.Direction)
+
+	binary.Write(buf, binary.BigEndian, templateID)
+	binary.Write(buf, binary.BigEndian, uint16(4+rec.Len()))
+	buf.Write(rec.Bytes())
+}
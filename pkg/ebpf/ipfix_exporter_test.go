@@ -0,0 +1,64 @@
+package nodefwloader
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// TestWriteIPFIXTemplateSetFieldCountMatchesWire decodes a Template Set
+// written by writeIPFIXTemplateSet and checks that the declared field count,
+// and the declared Set length, both match the field specifiers actually on
+// the wire. A mismatch here means a collector would either misparse the
+// following Data Records or silently drop/duplicate trailing bytes.
+func TestWriteIPFIXTemplateSetFieldCountMatchesWire(t *testing.T) {
+	var buf bytes.Buffer
+	writeIPFIXTemplateSet(&buf, ipfixTemplateIDv4, ieSourceIPv4Address, ieDestinationIPv4Address, 4)
+
+	data := buf.Bytes()
+	var setID, setLen uint16
+	r := bytes.NewReader(data)
+	if err := binary.Read(r, binary.BigEndian, &setID); err != nil {
+		t.Fatalf("reading Set ID: %v", err)
+	}
+	if err := binary.Read(r, binary.BigEndian, &setLen); err != nil {
+		t.Fatalf("reading Set length: %v", err)
+	}
+	if setID != ipfixTemplateSetID {
+		t.Fatalf("got Set ID %d, want %d", setID, ipfixTemplateSetID)
+	}
+	if int(setLen) != len(data) {
+		t.Fatalf("declared Set length %d does not match actual wire length %d", setLen, len(data))
+	}
+
+	var templateID, fieldCount uint16
+	if err := binary.Read(r, binary.BigEndian, &templateID); err != nil {
+		t.Fatalf("reading Template ID: %v", err)
+	}
+	if err := binary.Read(r, binary.BigEndian, &fieldCount); err != nil {
+		t.Fatalf("reading Field Count: %v", err)
+	}
+
+	var actualFields int
+	for r.Len() > 0 {
+		var ieID, length uint16
+		if err := binary.Read(r, binary.BigEndian, &ieID); err != nil {
+			t.Fatalf("reading field %d ieID: %v", actualFields, err)
+		}
+		if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+			t.Fatalf("reading field %d length: %v", actualFields, err)
+		}
+		if ieID&0x8000 != 0 {
+			var enterpriseNumber uint32
+			if err := binary.Read(r, binary.BigEndian, &enterpriseNumber); err != nil {
+				t.Fatalf("reading field %d enterprise number: %v", actualFields, err)
+			}
+			_ = enterpriseNumber
+		}
+		actualFields++
+	}
+
+	if int(fieldCount) != actualFields {
+		t.Fatalf("declared field count %d does not match %d field specifiers actually on the wire", fieldCount, actualFields)
+	}
+}
@@ -0,0 +1,58 @@
+package nodefwloader
+
+import (
+	"encoding/json"
+	"strconv"
+)
+
+// kafkaProducer is the minimal surface kafkaExporter needs from a Kafka
+// client, so this package depends only on an interface rather than a
+// specific client library; the caller supplies whichever one its binary
+// vendors (e.g. a confluent-kafka-go or sarama wrapper) via
+// newKafkaExporter.
+type kafkaProducer interface {
+	Produce(topic string, key, value []byte) error
+	Close() error
+}
+
+// kafkaExporter publishes one newline-free JSON message per flow event to a
+// Kafka topic, keyed by ruleId so a consumer group can partition by rule
+// while still seeing every event for a given rule in order.
+type kafkaExporter struct {
+	producer kafkaProducer
+	topic    string
+}
+
+// newKafkaExporter wraps an already-connected kafkaProducer as an
+// EventExporter publishing to topic.
+func newKafkaExporter(producer kafkaProducer, topic string) *kafkaExporter {
+	return &kafkaExporter{producer: producer, topic: topic}
+}
+
+func (k *kafkaExporter) Export(ev FirewallEvent) error {
+	value, err := json.Marshal(jsonFirewallEvent{
+		RuleId:    ev.RuleId,
+		Action:    convertXdpActionToString(ev.Action),
+		Direction: convertDirectionToString(ev.Direction),
+		Interface: ev.IfId,
+		Protocol:  ev.Proto,
+		SrcIP:     ev.SrcIP.String(),
+		DstIP:     ev.DstIP.String(),
+		SrcPort:   ev.SrcPort,
+		DstPort:   ev.DstPort,
+		Packets:   ev.Packets,
+		Bytes:     ev.Bytes,
+		TCPFlags:  ev.TCPFlags,
+		FirstSeen: ev.FirstSeen,
+		LastSeen:  ev.LastSeen,
+	})
+	if err != nil {
+		return err
+	}
+	key := []byte(strconv.FormatUint(uint64(ev.RuleId), 10))
+	return k.producer.Produce(k.topic, key, value)
+}
+
+func (k *kafkaExporter) Close() error {
+	return k.producer.Close()
+}
@@ -0,0 +1,415 @@
+package nodefwloader
+
+import (
+	"bufio"
+	"bytes"
+	"container/list"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	ingressnodefwiov1alpha1 "ingress-node-firewall/api/v1alpha1"
+)
+
+const (
+	// xdpPending is the action the kernel program assigns a packet when its
+	// rule carries an L7Match and the flow has no cached verdict yet: the
+	// packet is passed, and a copy of its bytes is sent to userspace over the
+	// perf ring for inspection.
+	xdpPending uint8 = 3
+
+	// defaultL7InspectPackets and defaultL7InspectBytes bound how much of a
+	// flow userspace will buffer looking for a ClientHello SNI or an HTTP
+	// request line before giving up; a flow whose rule has L7 criteria then
+	// gets a deny verdict.
+	defaultL7InspectPackets = 4
+	defaultL7InspectBytes   = 2048
+
+	// l7DecisionCacheSize bounds the LRU of per-flow verdicts kept in
+	// userspace, mirrored into the eBPF decision map the kernel consults for
+	// the rest of the flow's packets.
+	l7DecisionCacheSize = 4096
+
+	// l7PendingIdleTimeout bounds how long a flow may sit in l7Inspector.pending
+	// without a fresh PENDING event before it is dropped and its buffered bytes
+	// freed, so a stalled or scanned flow can't grow the map without bound.
+	l7PendingIdleTimeout = 10 * time.Second
+	// l7PendingSweepInterval controls how often the expiry goroutine scans
+	// l7Inspector.pending for idle entries.
+	l7PendingSweepInterval = 5 * time.Second
+)
+
+// l7RuleConfig is the parsed, userspace-only form of one rule's L7Match,
+// used to test a ClientHello SNI or an HTTP request against it.
+type l7RuleConfig struct {
+	serverNames []string
+	hosts       []string
+	methods     []string
+}
+
+// l7PendingFlow buffers the lead bytes of a flow the kernel marked xdpPending
+// while userspace is still waiting for enough data to reach a verdict.
+type l7PendingFlow struct {
+	buf      bytes.Buffer
+	packets  int
+	lastSeen time.Time
+}
+
+// l7Inspector implements the userspace half of L7 matching: it buffers the
+// PENDING bytes of each flow, parses out a TLS SNI or HTTP Host/method, and
+// pushes the resulting allow/deny verdict both into a local LRU (so repeated
+// lookups don't re-parse) and down into the kernel's decision map via push.
+type l7Inspector struct {
+	mu      sync.Mutex
+	rules   map[uint16]l7RuleConfig
+	pending map[flowKey]*l7PendingFlow
+	cache   *l7DecisionCache
+	push    func(flowKey, uint8)
+	stopCh  chan struct{}
+}
+
+// newL7Inspector creates an l7Inspector that calls push every time it
+// resolves a flow's verdict, so the caller can mirror it into the kernel map.
+func newL7Inspector(push func(flowKey, uint8)) *l7Inspector {
+	return &l7Inspector{
+		rules:   make(map[uint16]l7RuleConfig),
+		pending: make(map[flowKey]*l7PendingFlow),
+		cache:   newL7DecisionCache(l7DecisionCacheSize),
+		push:    push,
+		stopCh:  make(chan struct{}),
+	}
+}
+
+// run sweeps l7.pending on l7PendingSweepInterval, dropping any buffered flow
+// that has gone idle, until stop is called.
+func (l7 *l7Inspector) run() {
+	ticker := time.NewTicker(l7PendingSweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			l7.sweep()
+		case <-l7.stopCh:
+			return
+		}
+	}
+}
+
+// sweep drops every pending flow that has gone l7PendingIdleTimeout without a
+// fresh PENDING event, so a stalled or scanned flow can't hold its buffer
+// indefinitely.
+func (l7 *l7Inspector) sweep() {
+	now := time.Now()
+	l7.mu.Lock()
+	defer l7.mu.Unlock()
+	for key, pf := range l7.pending {
+		if now.Sub(pf.lastSeen) >= l7PendingIdleTimeout {
+			delete(l7.pending, key)
+		}
+	}
+}
+
+// stop terminates the sweep goroutine.
+func (l7 *l7Inspector) stop() {
+	close(l7.stopCh)
+}
+
+// setRule records or clears ruleId's L7 match criteria.
+func (l7 *l7Inspector) setRule(ruleId uint16, match *ingressnodefwiov1alpha1.L7Rule) {
+	l7.mu.Lock()
+	defer l7.mu.Unlock()
+	if match == nil {
+		delete(l7.rules, ruleId)
+		return
+	}
+	cfg := l7RuleConfig{}
+	if match.TLSRule != nil {
+		cfg.serverNames = match.TLSRule.ServerNames
+	}
+	if match.HTTPRule != nil {
+		cfg.hosts = match.HTTPRule.Hosts
+		cfg.methods = match.HTTPRule.Methods
+	}
+	l7.rules[ruleId] = cfg
+}
+
+// inspect folds one PENDING event's payload into the buffered flow. Once a
+// TLS ClientHello SNI or HTTP request line/Host is recognized, or the
+// inspection budget is exhausted first, it resolves and pushes a verdict and
+// stops buffering the flow.
+func (l7 *l7Inspector) inspect(key flowKey, ruleId uint16, payload []byte) {
+	if verdict, ok := l7.cache.get(key); ok {
+		// Already resolved this flow; re-push the cached verdict rather than
+		// re-buffering and re-parsing bytes we've already judged.
+		l7.push(key, verdict)
+		return
+	}
+
+	if len(payload) == 0 {
+		return
+	}
+
+	l7.mu.Lock()
+	pf, ok := l7.pending[key]
+	if !ok {
+		pf = &l7PendingFlow{}
+		l7.pending[key] = pf
+	}
+	pf.buf.Write(payload)
+	pf.packets++
+	pf.lastSeen = time.Now()
+	data := append([]byte(nil), pf.buf.Bytes()...)
+	budgetExhausted := pf.packets >= defaultL7InspectPackets || pf.buf.Len() >= defaultL7InspectBytes
+	cfg, haveRule := l7.rules[ruleId]
+	l7.mu.Unlock()
+
+	sni, ok := parseTLSClientHelloSNI(data)
+	host, method, httpOk := "", "", false
+	if !ok {
+		host, method, httpOk = parseHTTPRequestLine(data)
+	}
+	matched := ok || httpOk
+
+	if !matched && !budgetExhausted {
+		// Wait for more packets before giving up on this flow.
+		return
+	}
+
+	// A rule with an L7Match is only satisfied once we've actually read a
+	// matching SNI/Host/method; a flow we ran out of budget inspecting, or
+	// whose SNI/Host/method doesn't match, fails closed rather than silently
+	// allowing traffic an operator configured an L7 rule specifically to
+	// gate. A flow whose rule has no L7 criteria registered is allowed.
+	verdict := uint8(xdpAllow)
+	if haveRule {
+		verdict = xdpDeny
+		if matched && l7Allows(cfg, sni, host, method) {
+			verdict = xdpAllow
+		}
+	}
+
+	l7.mu.Lock()
+	delete(l7.pending, key)
+	l7.mu.Unlock()
+
+	l7.cache.put(key, verdict)
+	l7.push(key, verdict)
+}
+
+// l7Allows reports whether the parsed SNI/Host/method satisfy cfg.
+func l7Allows(cfg l7RuleConfig, sni, host, method string) bool {
+	if sni != "" && len(cfg.serverNames) > 0 {
+		return matchesAnyHostPattern(cfg.serverNames, sni)
+	}
+	if host != "" && len(cfg.hosts) > 0 {
+		if !matchesAnyHostPattern(cfg.hosts, host) {
+			return false
+		}
+		if len(cfg.methods) > 0 && method != "" {
+			return containsFold(cfg.methods, method)
+		}
+	}
+	return true
+}
+
+// matchesAnyHostPattern matches host against patterns, where a pattern
+// prefixed with "*." matches any subdomain of the remainder.
+func matchesAnyHostPattern(patterns []string, host string) bool {
+	host = strings.ToLower(host)
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(pattern)
+		if strings.HasPrefix(pattern, "*.") {
+			if strings.HasSuffix(host, pattern[1:]) {
+				return true
+			}
+			continue
+		}
+		if host == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// containsFold reports whether s is present in values, ignoring case.
+func containsFold(values []string, s string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseHTTPRequestLine attempts to parse data as the start of a cleartext
+// HTTP request and returns its Host header and method. ok is false if data
+// doesn't yet contain a complete request line and headers.
+func parseHTTPRequestLine(data []byte) (host, method string, ok bool) {
+	req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(data)))
+	if err != nil {
+		return "", "", false
+	}
+	return req.Host, req.Method, true
+}
+
+// parseTLSClientHelloSNI picks the server_name extension out of a raw TLS
+// ClientHello. It only understands enough of the handshake layout (RFC 8446
+// section 4.1.2 and the legacy server_name extension, RFC 6066 section 3) to
+// find that one extension, and returns ok=false for anything that doesn't
+// look like a complete, unfragmented ClientHello record yet.
+func parseTLSClientHelloSNI(data []byte) (sni string, ok bool) {
+	// TLS record header: type(1) version(2) length(2).
+	if len(data) < 5 || data[0] != 0x16 {
+		return "", false
+	}
+	recordLen := int(data[3])<<8 | int(data[4])
+	if len(data) < 5+recordLen {
+		return "", false
+	}
+	hs := data[5 : 5+recordLen]
+
+	// Handshake header: type(1) length(3); type 1 is ClientHello.
+	if len(hs) < 4 || hs[0] != 0x01 {
+		return "", false
+	}
+	hsLen := int(hs[1])<<16 | int(hs[2])<<8 | int(hs[3])
+	if len(hs) < 4+hsLen {
+		return "", false
+	}
+	body := hs[4 : 4+hsLen]
+
+	// client_version(2) random(32) session_id_len(1)+session_id
+	if len(body) < 35 {
+		return "", false
+	}
+	pos := 34
+	sessIDLen := int(body[pos])
+	pos++
+	if len(body) < pos+sessIDLen+2 {
+		return "", false
+	}
+	pos += sessIDLen
+
+	// cipher_suites_len(2)+cipher_suites
+	cipherLen := int(body[pos])<<8 | int(body[pos+1])
+	pos += 2
+	if len(body) < pos+cipherLen+1 {
+		return "", false
+	}
+	pos += cipherLen
+
+	// compression_methods_len(1)+compression_methods
+	compLen := int(body[pos])
+	pos++
+	if len(body) < pos+compLen+2 {
+		return "", false
+	}
+	pos += compLen
+
+	// extensions_len(2)+extensions
+	if len(body) < pos+2 {
+		return "", false
+	}
+	extLen := int(body[pos])<<8 | int(body[pos+1])
+	pos += 2
+	if len(body) < pos+extLen {
+		return "", false
+	}
+	extensions := body[pos : pos+extLen]
+
+	for len(extensions) >= 4 {
+		extType := int(extensions[0])<<8 | int(extensions[1])
+		extDataLen := int(extensions[2])<<8 | int(extensions[3])
+		if len(extensions) < 4+extDataLen {
+			return "", false
+		}
+		extData := extensions[4 : 4+extDataLen]
+		if extType == 0 { // server_name
+			return parseServerNameExtension(extData)
+		}
+		extensions = extensions[4+extDataLen:]
+	}
+	return "", false
+}
+
+// parseServerNameExtension extracts the hostname from a server_name
+// extension body (a list of (type, length, name) entries; only type 0, host
+// name, is defined).
+func parseServerNameExtension(data []byte) (string, bool) {
+	if len(data) < 2 {
+		return "", false
+	}
+	listLen := int(data[0])<<8 | int(data[1])
+	list := data[2:]
+	if len(list) < listLen {
+		return "", false
+	}
+	for len(list) >= 3 {
+		nameType := list[0]
+		nameLen := int(list[1])<<8 | int(list[2])
+		if len(list) < 3+nameLen {
+			return "", false
+		}
+		if nameType == 0 {
+			return string(list[3 : 3+nameLen]), true
+		}
+		list = list[3+nameLen:]
+	}
+	return "", false
+}
+
+// l7DecisionCache is a fixed-size, least-recently-used cache of per-flow L7
+// verdicts, mirroring the entries userspace has pushed into the kernel's
+// decision map so repeated PENDING events for the same flow short-circuit.
+type l7DecisionCache struct {
+	mu       sync.Mutex
+	capacity int
+	ll       *list.List
+	items    map[flowKey]*list.Element
+}
+
+type l7DecisionCacheEntry struct {
+	key     flowKey
+	verdict uint8
+}
+
+func newL7DecisionCache(capacity int) *l7DecisionCache {
+	return &l7DecisionCache{
+		capacity: capacity,
+		ll:       list.New(),
+		items:    make(map[flowKey]*list.Element),
+	}
+}
+
+// get returns the cached verdict for key, if any, promoting it to
+// most-recently-used.
+func (c *l7DecisionCache) get(key flowKey) (uint8, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.items[key]
+	if !ok {
+		return 0, false
+	}
+	c.ll.MoveToFront(el)
+	return el.Value.(*l7DecisionCacheEntry).verdict, true
+}
+
+func (c *l7DecisionCache) put(key flowKey, verdict uint8) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.items[key]; ok {
+		el.Value.(*l7DecisionCacheEntry).verdict = verdict
+		c.ll.MoveToFront(el)
+		return
+	}
+	el := c.ll.PushFront(&l7DecisionCacheEntry{key: key, verdict: verdict})
+	c.items[key] = el
+	if c.ll.Len() > c.capacity {
+		oldest := c.ll.Back()
+		if oldest != nil {
+			c.ll.Remove(oldest)
+			delete(c.items, oldest.Value.(*l7DecisionCacheEntry).key)
+		}
+	}
+}
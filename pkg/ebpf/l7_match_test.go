@@ -0,0 +1,74 @@
+package nodefwloader
+
+import "testing"
+
+func TestParseTLSClientHelloSNI(t *testing.T) {
+	sni := "example.com"
+	data := buildClientHello(sni)
+
+	got, ok := parseTLSClientHelloSNI(data)
+	if !ok {
+		t.Fatalf("expected to parse SNI, got ok=false")
+	}
+	if got != sni {
+		t.Fatalf("got SNI %q, want %q", got, sni)
+	}
+}
+
+func TestParseTLSClientHelloSNITruncated(t *testing.T) {
+	data := buildClientHello("example.com")
+	if _, ok := parseTLSClientHelloSNI(data[:len(data)-5]); ok {
+		t.Fatalf("expected truncated ClientHello to fail to parse")
+	}
+}
+
+func TestParseHTTPRequestLine(t *testing.T) {
+	req := "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"
+	host, method, ok := parseHTTPRequestLine([]byte(req))
+	if !ok {
+		t.Fatalf("expected to parse HTTP request, got ok=false")
+	}
+	if host != "example.com" || method != "GET" {
+		t.Fatalf("got host=%q method=%q, want host=example.com method=GET", host, method)
+	}
+}
+
+func TestParseHTTPRequestLineIncomplete(t *testing.T) {
+	if _, _, ok := parseHTTPRequestLine([]byte("GET / HTTP/1.1\r\n")); ok {
+		t.Fatalf("expected incomplete HTTP request to fail to parse")
+	}
+}
+
+func TestMatchesAnyHostPatternWildcard(t *testing.T) {
+	patterns := []string{"*.example.com"}
+	if !matchesAnyHostPattern(patterns, "api.example.com") {
+		t.Fatalf("expected api.example.com to match *.example.com")
+	}
+	if matchesAnyHostPattern(patterns, "example.org") {
+		t.Fatalf("expected example.org not to match *.example.com")
+	}
+}
+
+// buildClientHello constructs the minimal byte sequence
+// parseTLSClientHelloSNI understands: a TLS record containing one
+// ClientHello handshake message with a single server_name extension.
+func buildClientHello(sni string) []byte {
+	nameEntry := append([]byte{0x00, byte(len(sni) >> 8), byte(len(sni))}, []byte(sni)...)
+	serverNameList := append([]byte{byte(len(nameEntry) >> 8), byte(len(nameEntry))}, nameEntry...)
+	ext := append([]byte{0x00, 0x00, byte(len(serverNameList) >> 8), byte(len(serverNameList))}, serverNameList...)
+
+	body := []byte{}
+	body = append(body, make([]byte, 34)...) // client_version(2) + random(32)
+	body = append(body, 0x00)                // session_id_len
+	body = append(body, 0x00, 0x02)          // cipher_suites_len
+	body = append(body, 0x00, 0x2f)          // one cipher suite
+	body = append(body, 0x01)                // compression_methods_len
+	body = append(body, 0x00)                // one compression method
+	body = append(body, byte(len(ext)>>8), byte(len(ext)))
+	body = append(body, ext...)
+
+	hs := append([]byte{0x01, byte(len(body) >> 16), byte(len(body) >> 8), byte(len(body))}, body...)
+
+	record := append([]byte{0x16, 0x03, 0x03, byte(len(hs) >> 8), byte(len(hs))}, hs...)
+	return record
+}
@@ -0,0 +1,222 @@
+package nodefwloader
+
+import (
+	"log"
+	"os"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// perfBufferPagesPerCPU scales the per-CPU perf ring buffer so busy
+	// nodes with more CPUs (and therefore more concurrent producers) get a
+	// proportionally larger buffer instead of the single-page default.
+	perfBufferPagesPerCPU = 16
+
+	// sampleRateMin and sampleRateMax bound the 1-in-K sampling rate the
+	// kernel program is told to apply per (ruleId, action) bucket.
+	sampleRateMin = 1
+	sampleRateMax = 1024
+
+	// dropPressureDecayWindow is how long a bucket's sample rate must go
+	// without a fresh drop before it starts decaying back toward 1-in-1.
+	dropPressureDecayWindow = 30 * time.Second
+
+	// sampleDecayInterval controls how often the decay loop reassesses
+	// every bucket's sample rate.
+	sampleDecayInterval = 5 * time.Second
+)
+
+// perfBufferSize returns the perf.NewReader buffer size to use: one page per
+// CPU, scaled up so bursts on a busy node don't immediately overrun it.
+func perfBufferSize() int {
+	return runtime.NumCPU() * os.Getpagesize() * perfBufferPagesPerCPU
+}
+
+// sampleBucketKey identifies one (ruleId, action) bucket the kernel program
+// applies its own independent 1-in-K sampling rate to.
+type sampleBucketKey struct {
+	ruleId uint16
+	action uint8
+}
+
+// perfSampler tracks perf-ring drop pressure and, when it persists, pushes a
+// stochastic 1-in-K sampling rate into a shared eBPF map so the kernel
+// program only emits a fraction of matching events instead of flooding the
+// ring, while the rule statistics map keeps counting every real packet.
+// Prometheus counters expose dropped/processed/sampled totals so operators
+// can see how aggressively a node is currently sampling.
+type perfSampler struct {
+	mu        sync.Mutex
+	rates     map[sampleBucketKey]uint32
+	lastHit   map[sampleBucketKey]time.Time
+	recent    sampleBucketKey
+	hasRecent bool
+	push      func(sampleBucketKey, uint32) error
+	stopCh    chan struct{}
+
+	registry  *prometheus.Registry
+	dropped   prometheus.Counter
+	processed prometheus.Counter
+	sampled   prometheus.Counter
+}
+
+// newPerfSampler creates a perfSampler that calls push whenever a bucket's
+// sample rate changes, so the caller can mirror it into the kernel map.
+func newPerfSampler(push func(sampleBucketKey, uint32) error) *perfSampler {
+	registry := prometheus.NewRegistry()
+	s := &perfSampler{
+		rates:   make(map[sampleBucketKey]uint32),
+		lastHit: make(map[sampleBucketKey]time.Time),
+		push:    push,
+		stopCh:  make(chan struct{}),
+
+		registry: registry,
+		dropped: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "ingress_node_firewall_perf_events_dropped_total",
+			Help: "Perf ring buffer samples lost before userspace could read them.",
+		}),
+		processed: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "ingress_node_firewall_perf_events_processed_total",
+			Help: "Perf ring buffer samples successfully read and decoded.",
+		}),
+		sampled: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "ingress_node_firewall_perf_events_sampled_total",
+			Help: "Processed samples that were subject to a 1-in-K sampling rate greater than 1.",
+		}),
+	}
+	registry.MustRegister(s.dropped, s.processed, s.sampled)
+	return s
+}
+
+// recordDropped accounts for lost samples and, on sustained loss, escalates
+// the sample rate for the bucket that was most recently processed (a proxy
+// for whichever bucket is currently flooding the ring) rather than every
+// bucket perfSampler has ever seen. The kernel map update that push performs
+// runs synchronously on the caller's goroutine, after s.mu is released.
+func (s *perfSampler) recordDropped(n uint64) {
+	s.dropped.Add(float64(n))
+
+	s.mu.Lock()
+	if !s.hasRecent {
+		s.mu.Unlock()
+		return
+	}
+	key := s.recent
+	next, changed := s.escalateLocked(key, time.Now())
+	s.mu.Unlock()
+
+	if changed {
+		s.pushRate(key, next)
+	}
+}
+
+// recordProcessed accounts for one successfully decoded event for the given
+// rule/action bucket, registering the bucket if this is the first time it's
+// been seen and recording it as the most recently active bucket so a later
+// recordDropped knows which one to escalate.
+func (s *perfSampler) recordProcessed(ruleId uint16, action uint8) {
+	s.processed.Add(1)
+
+	key := sampleBucketKey{ruleId: ruleId, action: action}
+	s.mu.Lock()
+	now := time.Now()
+	s.lastHit[key] = now
+	s.recent = key
+	s.hasRecent = true
+	if _, ok := s.rates[key]; !ok {
+		s.rates[key] = sampleRateMin
+	}
+	rate := s.rates[key]
+	s.mu.Unlock()
+
+	if rate > sampleRateMin {
+		s.sampled.Add(1)
+	}
+}
+
+// escalateLocked doubles key's sample rate (capped at sampleRateMax) and
+// reports whether it changed; the caller is responsible for pushing the new
+// rate to the kernel after releasing s.mu. Callers must hold s.mu.
+func (s *perfSampler) escalateLocked(key sampleBucketKey, now time.Time) (uint32, bool) {
+	rate := s.rates[key]
+	if rate == 0 {
+		rate = sampleRateMin
+	}
+	next := rate * 2
+	if next > sampleRateMax {
+		next = sampleRateMax
+	}
+	if next == rate {
+		return rate, false
+	}
+	s.rates[key] = next
+	s.lastHit[key] = now
+	return next, true
+}
+
+// pushRate calls push for key outside of s.mu, logging (rather than
+// blocking the caller) on failure.
+func (s *perfSampler) pushRate(key sampleBucketKey, rate uint32) {
+	if err := s.push(key, rate); err != nil {
+		log.Printf("Failed updating sample rate map for ruleId %d action %d: %v", key.ruleId, key.action, err)
+	}
+}
+
+// run periodically decays every bucket's sample rate back toward 1-in-1 once
+// it has gone dropPressureDecayWindow without fresh drop pressure, until
+// stop is called.
+func (s *perfSampler) run() {
+	ticker := time.NewTicker(sampleDecayInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.decay()
+		case <-s.stopCh:
+			return
+		}
+	}
+}
+
+// decay halves any bucket's sample rate that hasn't seen fresh drop pressure
+// within dropPressureDecayWindow. The kernel map updates happen after s.mu is
+// released so a slow push can't hold up recordDropped/recordProcessed.
+func (s *perfSampler) decay() {
+	now := time.Now()
+
+	s.mu.Lock()
+	type update struct {
+		key  sampleBucketKey
+		rate uint32
+	}
+	var updates []update
+	for key, rate := range s.rates {
+		if rate <= sampleRateMin {
+			continue
+		}
+		if now.Sub(s.lastHit[key]) < dropPressureDecayWindow {
+			continue
+		}
+		next := rate / 2
+		if next < sampleRateMin {
+			next = sampleRateMin
+		}
+		s.rates[key] = next
+		s.lastHit[key] = now
+		updates = append(updates, update{key, next})
+	}
+	s.mu.Unlock()
+
+	for _, u := range updates {
+		s.pushRate(u.key, u.rate)
+	}
+}
+
+// stop terminates the decay goroutine.
+func (s *perfSampler) stop() {
+	close(s.stopCh)
+}
@@ -0,0 +1,110 @@
+package nodefwloader
+
+import (
+	"testing"
+	"time"
+)
+
+func newTestSampler() (*perfSampler, *[]struct {
+	key  sampleBucketKey
+	rate uint32
+}) {
+	pushed := &[]struct {
+		key  sampleBucketKey
+		rate uint32
+	}{}
+	s := newPerfSampler(func(key sampleBucketKey, rate uint32) error {
+		*pushed = append(*pushed, struct {
+			key  sampleBucketKey
+			rate uint32
+		}{key, rate})
+		return nil
+	})
+	return s, pushed
+}
+
+func TestPerfSamplerEscalateLockedDoublesAndCaps(t *testing.T) {
+	s, _ := newTestSampler()
+	key := sampleBucketKey{ruleId: 1, action: xdpDeny}
+
+	s.mu.Lock()
+	next, changed := s.escalateLocked(key, time.Now())
+	s.mu.Unlock()
+	if !changed || next != sampleRateMin*2 {
+		t.Fatalf("got next=%d changed=%v, want next=%d changed=true", next, changed, sampleRateMin*2)
+	}
+
+	// Escalate until the rate saturates at sampleRateMax.
+	for i := 0; i < 20; i++ {
+		s.mu.Lock()
+		next, changed = s.escalateLocked(key, time.Now())
+		s.mu.Unlock()
+		if next > sampleRateMax {
+			t.Fatalf("rate %d exceeded sampleRateMax %d", next, sampleRateMax)
+		}
+	}
+	if next != sampleRateMax {
+		t.Fatalf("got final rate %d, want saturated at %d", next, sampleRateMax)
+	}
+	s.mu.Lock()
+	_, changed = s.escalateLocked(key, time.Now())
+	s.mu.Unlock()
+	if changed {
+		t.Fatalf("expected no further change once rate is saturated at sampleRateMax")
+	}
+}
+
+func TestPerfSamplerRecordDroppedEscalatesOnlyRecentBucket(t *testing.T) {
+	s, pushed := newTestSampler()
+	other := sampleBucketKey{ruleId: 1, action: xdpDeny}
+	recent := sampleBucketKey{ruleId: 2, action: xdpAllow}
+
+	s.recordProcessed(other.ruleId, other.action)
+	s.recordProcessed(recent.ruleId, recent.action)
+
+	s.recordDropped(5)
+
+	if len(*pushed) != 1 {
+		t.Fatalf("expected exactly 1 pushed rate change, got %d", len(*pushed))
+	}
+	if (*pushed)[0].key != recent {
+		t.Fatalf("expected only the most-recently-active bucket %+v to escalate, got %+v", recent, (*pushed)[0].key)
+	}
+
+	s.mu.Lock()
+	otherRate := s.rates[other]
+	s.mu.Unlock()
+	if otherRate > sampleRateMin {
+		t.Fatalf("expected bucket %+v untouched by recordDropped, got rate %d", other, otherRate)
+	}
+}
+
+func TestPerfSamplerDecayHalvesStaleRateAndSkipsFreshOnes(t *testing.T) {
+	s, pushed := newTestSampler()
+	stale := sampleBucketKey{ruleId: 1, action: xdpDeny}
+	fresh := sampleBucketKey{ruleId: 2, action: xdpAllow}
+
+	s.mu.Lock()
+	s.rates[stale] = 8
+	s.lastHit[stale] = time.Now().Add(-2 * dropPressureDecayWindow)
+	s.rates[fresh] = 8
+	s.lastHit[fresh] = time.Now()
+	s.mu.Unlock()
+
+	s.decay()
+
+	s.mu.Lock()
+	staleRate := s.rates[stale]
+	freshRate := s.rates[fresh]
+	s.mu.Unlock()
+
+	if staleRate != 4 {
+		t.Fatalf("got stale bucket rate %d, want 4 (halved from 8)", staleRate)
+	}
+	if freshRate != 8 {
+		t.Fatalf("got fresh bucket rate %d, want unchanged at 8", freshRate)
+	}
+	if len(*pushed) != 1 || (*pushed)[0].key != stale || (*pushed)[0].rate != 4 {
+		t.Fatalf("expected exactly one push for the stale bucket's new rate, got %+v", *pushed)
+	}
+}